@@ -0,0 +1,366 @@
+package transactionlogger
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// FileOptions configures rotation and fsync behaviour for PublisherFile.
+// Zero values disable the corresponding rotation trigger; FsyncPolicy
+// defaults to "none".
+type FileOptions struct {
+	MaxSize     int64         // rotate once the file would exceed this many bytes, 0 = never
+	MaxAge      time.Duration // rotate once the file is older than this, 0 = never
+	MaxBackups  int           // keep at most this many rotated backups, 0 = keep all
+	Compress    bool          // gzip rotated backups in the background
+	FsyncPolicy string        // "none" (default), "batch", "always"
+	FsyncEveryN int           // batch policy: fsync after this many writes
+	FsyncEvery  time.Duration // batch policy: fsync at least this often
+}
+
+// parseSize parses sizes like "100MB", "512kb", "1g" or a bare byte count.
+func parseSize(s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	re := regexp.MustCompile(`(?i)^([0-9]+)\s*(b|kb|mb|gb)?$`)
+	match := re.FindStringSubmatch(strings.TrimSpace(s))
+	if match == nil {
+		return 0, fmt.Errorf("Failed to parse size '%s'", s)
+	}
+	n, err := strconv.ParseInt(match[1], 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	switch strings.ToLower(match[2]) {
+	case "kb":
+		n *= 1 << 10
+	case "mb":
+		n *= 1 << 20
+	case "gb":
+		n *= 1 << 30
+	}
+	return n, nil
+}
+
+// FileOptionsFromQuery builds FileOptions from the file:// URL query
+// parameters: max_size, max_age, max_backups, compress, fsync.
+func FileOptionsFromQuery(query map[string]string) (FileOptions, error) {
+	opts := FileOptions{FsyncPolicy: "none", FsyncEveryN: 100, FsyncEvery: time.Second}
+
+	var err error
+	if v := query["max_size"]; v != "" {
+		if opts.MaxSize, err = parseSize(v); err != nil {
+			return opts, err
+		}
+	}
+	if v := query["max_age"]; v != "" {
+		if opts.MaxAge, err = time.ParseDuration(v); err != nil {
+			return opts, fmt.Errorf("Failed to parse max_age '%s': %v", v, err)
+		}
+	}
+	if v := query["max_backups"]; v != "" {
+		if opts.MaxBackups, err = strconv.Atoi(v); err != nil {
+			return opts, fmt.Errorf("Failed to parse max_backups '%s': %v", v, err)
+		}
+	}
+	if v := query["compress"]; v != "" && v != "none" {
+		opts.Compress = true
+	}
+	if v := query["fsync"]; v != "" {
+		switch v {
+		case "none", "batch", "always":
+			opts.FsyncPolicy = v
+		default:
+			return opts, fmt.Errorf("Invalid fsync policy '%s': want none, batch, or always", v)
+		}
+	}
+
+	return opts, nil
+}
+
+type PublisherFile struct {
+	ch   chan string
+	path string
+	opts FileOptions
+
+	mu        sync.Mutex
+	file      *os.File
+	size      int64
+	openedAt  time.Time
+	sinceSync int
+	lastSync  time.Time
+
+	gate            *overflowGate
+	closer          *closer
+	messagesWritten uint64
+
+	lastErrMu sync.Mutex
+	lastErr   string
+
+	sighup     chan os.Signal
+	sighupStop chan struct{}
+}
+
+func (this *PublisherFile) Push(s string) bool {
+	return this.closer.withOpen(func() bool {
+		return this.gate.push(this.ch, s)
+	})
+}
+
+func (this *PublisherFile) Stats() PublisherStats {
+	this.lastErrMu.Lock()
+	lastErr := this.lastErr
+	this.lastErrMu.Unlock()
+	return PublisherStats{
+		MessagesWritten: atomic.LoadUint64(&this.messagesWritten),
+		Dropped:         this.gate.droppedCount(),
+		LastError:       lastErr,
+	}
+}
+
+func (this *PublisherFile) recordError(err error) {
+	this.lastErrMu.Lock()
+	this.lastErr = err.Error()
+	this.lastErrMu.Unlock()
+}
+
+func (this *PublisherFile) Close(ctx context.Context) error {
+	if !this.closer.beginClose() {
+		return nil
+	}
+	close(this.ch)
+	close(this.gate.stop)
+	signal.Stop(this.sighup)
+	close(this.sighupStop)
+
+	err := this.closer.waitDone(ctx)
+
+	this.mu.Lock()
+	if this.file != nil {
+		this.file.Sync()
+		this.file.Close()
+	}
+	this.mu.Unlock()
+
+	return err
+}
+
+func (this *PublisherFile) start() {
+	go func() {
+		for s := range this.ch {
+			this.writeLine(s)
+		}
+		this.closer.markDone()
+	}()
+	go this.watchSighup()
+}
+
+func (this *PublisherFile) watchSighup() {
+	for {
+		select {
+		case <-this.sighup:
+			this.mu.Lock()
+			if err := this.reopenLocked(); err != nil {
+				this.recordError(err)
+			}
+			this.mu.Unlock()
+		case <-this.sighupStop:
+			return
+		}
+	}
+}
+
+func (this *PublisherFile) writeLine(s string) {
+	line := s + "\n"
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if this.shouldRotateLocked(int64(len(line))) {
+		if err := this.rotateLocked(); err != nil {
+			this.recordError(err)
+		}
+	}
+
+	n, err := this.file.WriteString(line)
+	if err != nil {
+		this.recordError(err)
+		return
+	}
+	this.size += int64(n)
+	atomic.AddUint64(&this.messagesWritten, 1)
+	this.maybeSyncLocked()
+}
+
+func (this *PublisherFile) shouldRotateLocked(nextWrite int64) bool {
+	if this.opts.MaxSize > 0 && this.size+nextWrite > this.opts.MaxSize {
+		return true
+	}
+	if this.opts.MaxAge > 0 && time.Since(this.openedAt) > this.opts.MaxAge {
+		return true
+	}
+	return false
+}
+
+func (this *PublisherFile) maybeSyncLocked() {
+	switch this.opts.FsyncPolicy {
+	case "always":
+		this.file.Sync()
+	case "batch":
+		this.sinceSync++
+		if this.sinceSync >= this.opts.FsyncEveryN || time.Since(this.lastSync) >= this.opts.FsyncEvery {
+			this.file.Sync()
+			this.sinceSync = 0
+			this.lastSync = time.Now()
+		}
+	}
+}
+
+// rotateLocked renames the current file aside with a timestamp suffix,
+// reopens path for append, and prunes old backups. Called with this.mu held.
+func (this *PublisherFile) rotateLocked() error {
+	if this.file != nil {
+		this.file.Close()
+	}
+
+	rotatedName := this.nextBackupNameLocked()
+	if err := os.Rename(this.path, rotatedName); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	go this.finishRotation(rotatedName)
+
+	return this.openLocked()
+}
+
+// nextBackupNameLocked picks a rotated-backup path for this.path that does
+// not already exist. A second-resolution timestamp alone collides when
+// max_size triggers rotations faster than 1/sec, silently overwriting the
+// previous backup on os.Rename; once that happens this appends an
+// increasing counter until it finds a free name. Called with this.mu held.
+func (this *PublisherFile) nextBackupNameLocked() string {
+	base := fmt.Sprintf("%s.%s", this.path, time.Now().Format("20060102-150405"))
+	name := base
+	for n := 1; ; n++ {
+		if _, err := os.Stat(name); os.IsNotExist(err) {
+			return name
+		}
+		name = fmt.Sprintf("%s.%d", base, n)
+	}
+}
+
+// reopenLocked closes and reopens the file at the same path without
+// renaming it, for compatibility with external logrotate-style rotation
+// triggered by SIGHUP.
+func (this *PublisherFile) reopenLocked() error {
+	if this.file != nil {
+		this.file.Close()
+	}
+	return this.openLocked()
+}
+
+func (this *PublisherFile) openLocked() error {
+	f, err := os.OpenFile(this.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	this.file = f
+	this.size = info.Size()
+	this.openedAt = time.Now()
+	return nil
+}
+
+// finishRotation compresses the just-rotated backup, if configured, and only
+// then prunes old backups - running both in one goroutine keeps pruning
+// from racing a still-in-progress (or not yet started) compression of the
+// very backup it might otherwise delete or leave half-written.
+func (this *PublisherFile) finishRotation(rotatedName string) {
+	if this.opts.Compress {
+		compressBackup(rotatedName)
+	}
+	pruneBackups(this.path, this.opts.MaxBackups)
+}
+
+func compressBackup(name string) {
+	src, err := os.Open(name)
+	if err != nil {
+		return
+	}
+	defer src.Close()
+
+	dst, err := os.Create(name + ".gz")
+	if err != nil {
+		return
+	}
+	defer dst.Close()
+
+	gz := gzip.NewWriter(dst)
+	if _, err := io.Copy(gz, src); err != nil {
+		gz.Close()
+		return
+	}
+	if err := gz.Close(); err != nil {
+		return
+	}
+	os.Remove(name)
+}
+
+// pruneBackups keeps at most maxBackups rotated copies of path (both plain
+// and .gz), removing the oldest first. maxBackups <= 0 means keep all.
+func pruneBackups(path string, maxBackups int) {
+	if maxBackups <= 0 {
+		return
+	}
+
+	matches, err := filepath.Glob(path + ".*")
+	if err != nil {
+		return
+	}
+	sort.Strings(matches)
+
+	if len(matches) <= maxBackups {
+		return
+	}
+	for _, stale := range matches[:len(matches)-maxBackups] {
+		os.Remove(stale)
+	}
+}
+
+func NewFile(logChSize int, path string, opts FileOptions) (Publisher, error) {
+	publisher := &PublisherFile{
+		ch:         make(chan string, logChSize),
+		path:       path,
+		opts:       opts,
+		gate:       newOverflowGate(),
+		closer:     newCloser(),
+		sighup:     make(chan os.Signal, 1),
+		sighupStop: make(chan struct{}),
+	}
+
+	if err := publisher.openLocked(); err != nil {
+		return nil, err
+	}
+
+	signal.Notify(publisher.sighup, syscall.SIGHUP)
+	publisher.start()
+	return publisher, nil
+}
@@ -0,0 +1,146 @@
+package transactionlogger
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// OverflowPolicy controls what Push does once a publisher's channel is full.
+type OverflowPolicy int
+
+const (
+	OverflowBlock OverflowPolicy = iota
+	OverflowDropNew
+	OverflowDropOldest
+	OverflowSample
+)
+
+const overflowReportInterval = 10 * time.Second
+
+// overflowPolicyFromEnv reads TRANSACTION_LOGGER_OVERFLOW: "block",
+// "drop_new", "drop_oldest", or "sample_1_in_N". An unset/empty value falls
+// back to defaultPolicy, since not every publisher can afford to block its
+// caller while its channel is full.
+func overflowPolicyFromEnv(defaultPolicy OverflowPolicy) (OverflowPolicy, int) {
+	switch v := os.Getenv("TRANSACTION_LOGGER_OVERFLOW"); {
+	case v == "":
+		return defaultPolicy, 0
+	case v == "block":
+		return OverflowBlock, 0
+	case v == "drop_new":
+		return OverflowDropNew, 0
+	case v == "drop_oldest":
+		return OverflowDropOldest, 0
+	case strings.HasPrefix(v, "sample_1_in_"):
+		n, err := strconv.Atoi(strings.TrimPrefix(v, "sample_1_in_"))
+		if err != nil || n <= 0 {
+			n = 1
+		}
+		return OverflowSample, n
+	default:
+		return defaultPolicy, 0
+	}
+}
+
+// overflowGate centralizes the non-blocking-Push overflow policy shared by
+// every Publisher backed by a buffered string channel, plus a periodic
+// summary of how many messages it has had to drop.
+type overflowGate struct {
+	policy  OverflowPolicy
+	sampleN int
+	counter uint64
+	dropped uint64
+	stop    chan struct{}
+}
+
+// newOverflowGate builds a gate that blocks Push when the channel is full,
+// unless TRANSACTION_LOGGER_OVERFLOW says otherwise. Use this for publishers
+// where blocking the caller is an acceptable (or desired) backpressure
+// signal.
+func newOverflowGate() *overflowGate {
+	return newOverflowGateWithDefault(OverflowBlock)
+}
+
+// newOverflowGateWithDefault is like newOverflowGate but lets the publisher
+// pick what happens when TRANSACTION_LOGGER_OVERFLOW is unset.
+func newOverflowGateWithDefault(defaultPolicy OverflowPolicy) *overflowGate {
+	policy, sampleN := overflowPolicyFromEnv(defaultPolicy)
+	gate := &overflowGate{policy: policy, sampleN: sampleN, stop: make(chan struct{})}
+	go gate.reportLoop()
+	return gate
+}
+
+// push delivers s to ch according to the configured policy, returning false
+// if s was dropped instead.
+func (g *overflowGate) push(ch chan string, s string) bool {
+	switch g.policy {
+	case OverflowDropNew:
+		select {
+		case ch <- s:
+			return true
+		default:
+			atomic.AddUint64(&g.dropped, 1)
+			return false
+		}
+	case OverflowDropOldest:
+		select {
+		case ch <- s:
+			return true
+		default:
+		}
+		select {
+		case <-ch:
+			atomic.AddUint64(&g.dropped, 1)
+		default:
+		}
+		select {
+		case ch <- s:
+			return true
+		default:
+			atomic.AddUint64(&g.dropped, 1)
+			return false
+		}
+	case OverflowSample:
+		if atomic.AddUint64(&g.counter, 1)%uint64(g.sampleN) != 0 {
+			atomic.AddUint64(&g.dropped, 1)
+			return false
+		}
+		select {
+		case ch <- s:
+			return true
+		default:
+			atomic.AddUint64(&g.dropped, 1)
+			return false
+		}
+	default: // OverflowBlock
+		ch <- s
+		return true
+	}
+}
+
+func (g *overflowGate) droppedCount() uint64 {
+	return atomic.LoadUint64(&g.dropped)
+}
+
+func (g *overflowGate) reportLoop() {
+	ticker := time.NewTicker(overflowReportInterval)
+	defer ticker.Stop()
+
+	var lastReported uint64
+	for {
+		select {
+		case <-ticker.C:
+			dropped := atomic.LoadUint64(&g.dropped)
+			if dropped != lastReported {
+				fmt.Fprintf(os.Stderr, "transactionlogger: dropped %d messages in last %s\n", dropped-lastReported, overflowReportInterval)
+				lastReported = dropped
+			}
+		case <-g.stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package transactionlogger
+
+import (
+	"os"
+	"testing"
+)
+
+// BenchmarkPublisherStdoutPushDropOldest and BenchmarkPublisherStdoutPushDropNew
+// drive Push against a full channel (no consumer draining it) to demonstrate
+// that the non-blocking overflow policies keep Push itself well under a
+// microsecond, regardless of how backed up the consumer is.
+func BenchmarkPublisherStdoutPushDropOldest(b *testing.B) {
+	os.Setenv("TRANSACTION_LOGGER_OVERFLOW", "drop_oldest")
+	defer os.Unsetenv("TRANSACTION_LOGGER_OVERFLOW")
+
+	publisher := &PublisherStdout{ch: make(chan string, 16), gate: newOverflowGate(), closer: newCloser()}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		publisher.Push("transaction")
+	}
+}
+
+func BenchmarkPublisherStdoutPushDropNew(b *testing.B) {
+	os.Setenv("TRANSACTION_LOGGER_OVERFLOW", "drop_new")
+	defer os.Unsetenv("TRANSACTION_LOGGER_OVERFLOW")
+
+	publisher := &PublisherStdout{ch: make(chan string, 16), gate: newOverflowGate(), closer: newCloser()}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		publisher.Push("transaction")
+	}
+}
+
+// TestPushBenchmarksAreSubMicrosecond runs under plain `go test`, unlike the
+// benchmarks above which only run under `go test -bench`, so a broken or
+// panicking Push benchmark fails the build instead of going unnoticed.
+func TestPushBenchmarksAreSubMicrosecond(t *testing.T) {
+	for _, bm := range []struct {
+		name string
+		fn   func(*testing.B)
+	}{
+		{"DropOldest", BenchmarkPublisherStdoutPushDropOldest},
+		{"DropNew", BenchmarkPublisherStdoutPushDropNew},
+	} {
+		result := testing.Benchmark(bm.fn)
+		if result.NsPerOp() >= 1000 {
+			t.Errorf("%s: Push took %dns/op, want sub-microsecond", bm.name, result.NsPerOp())
+		}
+	}
+}
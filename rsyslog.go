@@ -0,0 +1,397 @@
+package transactionlogger
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log/syslog"
+	"math/rand"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// PublisherStats carries the counters exposed by Publisher.Stats().
+// Not every publisher tracks every field; zero means "not applicable".
+type PublisherStats struct {
+	MessagesWritten uint64
+	Reconnects      uint64
+	Dropped         uint64
+	LastError       string
+}
+
+const (
+	rsyslogBackoffInitial = 100 * time.Millisecond
+	rsyslogBackoffMax     = 30 * time.Second
+)
+
+// Formatter renders a single log message as the body that goes out over the
+// wire to rsyslog, given the local hostname, the configured tag and the
+// message itself.
+type Formatter func(hostname, tag, msg string) string
+
+// RFC3164Formatter returns a Formatter producing classic BSD syslog
+// ("<PRI>Mmm dd hh:mm:ss hostname tag: msg") lines for the given priority.
+func RFC3164Formatter(pri syslog.Priority) Formatter {
+	return func(hostname, tag, msg string) string {
+		timestamp := time.Now().Format(time.Stamp)
+		if tag == "" {
+			return fmt.Sprintf("<%d>%s %s %s", pri, timestamp, hostname, msg)
+		}
+		return fmt.Sprintf("<%d>%s %s %s: %s", pri, timestamp, hostname, tag, msg)
+	}
+}
+
+// RFC5424Formatter returns a Formatter producing structured-data syslog
+// lines per RFC5424: "<PRI>1 TIMESTAMP HOSTNAME APP-NAME PROCID MSGID [SD] MSG".
+// APP-NAME is reused as MSGID for rsyslog %syslogtag% compatibility, and
+// structured data is omitted (the RFC5424 nil value "-") since we have none.
+func RFC5424Formatter(pri syslog.Priority) Formatter {
+	pid := os.Getpid()
+	return func(hostname, tag, msg string) string {
+		appName := tag
+		if appName == "" {
+			appName = "-"
+		}
+		timestamp := time.Now().Format(time.RFC3339)
+		return fmt.Sprintf("<%d>1 %s %s %s %d %s - %s", pri, timestamp, hostname, appName, pid, appName, msg)
+	}
+}
+
+var facilities = map[string]syslog.Priority{
+	"kern":     syslog.LOG_KERN,
+	"user":     syslog.LOG_USER,
+	"mail":     syslog.LOG_MAIL,
+	"daemon":   syslog.LOG_DAEMON,
+	"auth":     syslog.LOG_AUTH,
+	"syslog":   syslog.LOG_SYSLOG,
+	"lpr":      syslog.LOG_LPR,
+	"news":     syslog.LOG_NEWS,
+	"uucp":     syslog.LOG_UUCP,
+	"cron":     syslog.LOG_CRON,
+	"authpriv": syslog.LOG_AUTHPRIV,
+	"ftp":      syslog.LOG_FTP,
+	"local0":   syslog.LOG_LOCAL0,
+	"local1":   syslog.LOG_LOCAL1,
+	"local2":   syslog.LOG_LOCAL2,
+	"local3":   syslog.LOG_LOCAL3,
+	"local4":   syslog.LOG_LOCAL4,
+	"local5":   syslog.LOG_LOCAL5,
+	"local6":   syslog.LOG_LOCAL6,
+	"local7":   syslog.LOG_LOCAL7,
+}
+
+var severities = map[string]syslog.Priority{
+	"emerg":   syslog.LOG_EMERG,
+	"alert":   syslog.LOG_ALERT,
+	"crit":    syslog.LOG_CRIT,
+	"err":     syslog.LOG_ERR,
+	"warning": syslog.LOG_WARNING,
+	"notice":  syslog.LOG_NOTICE,
+	"info":    syslog.LOG_INFO,
+	"debug":   syslog.LOG_DEBUG,
+}
+
+// RsyslogFormat selects the facility, severity, tag, and wire format used by
+// NewRsyslog. An empty field falls back to the historical default: facility
+// "user", severity "debug", no tag, RFC3164 text.
+type RsyslogFormat struct {
+	Facility string
+	Severity string
+	Tag      string
+	Format   string
+}
+
+// RsyslogOptions configures the transport NewRsyslog dials. Network selects
+// "tcp" (default), "udp", "tls", or "unixgram"; TLSConfig is only consulted
+// for "tls".
+type RsyslogOptions struct {
+	Network   string
+	TLSConfig *tls.Config
+	RsyslogFormat
+}
+
+// TLSConfigFromEnv builds a *tls.Config for the rsyslog+tls transport from
+// TRANSACTION_LOGGER_CA (PEM root CA), TRANSACTION_LOGGER_CERT/_KEY (PEM
+// client certificate) and TRANSACTION_LOGGER_SKIP_VERIFY ("1"/"true").
+func TLSConfigFromEnv() (*tls.Config, error) {
+	config := &tls.Config{}
+
+	if v := os.Getenv("TRANSACTION_LOGGER_SKIP_VERIFY"); v == "1" || strings.EqualFold(v, "true") {
+		config.InsecureSkipVerify = true
+	}
+
+	if caFile := os.Getenv("TRANSACTION_LOGGER_CA"); caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read CA certificate '%s': %v", caFile, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("Failed to parse CA certificate '%s'", caFile)
+		}
+		config.RootCAs = pool
+	}
+
+	certFile := os.Getenv("TRANSACTION_LOGGER_CERT")
+	keyFile := os.Getenv("TRANSACTION_LOGGER_KEY")
+	if certFile != "" && keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to load client certificate '%s'/'%s': %v", certFile, keyFile, err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
+
+// octetFramer wraps a net.Conn so that every Write is sent as an RFC5425
+// octet-counted frame ("LEN MSG") instead of a newline-terminated line, as
+// required when shipping syslog over TLS.
+type octetFramer struct {
+	net.Conn
+}
+
+func (c octetFramer) Write(p []byte) (int, error) {
+	p = bytes.TrimSuffix(p, []byte("\n"))
+	frame := fmt.Sprintf("%d %s", len(p), p)
+	if _, err := c.Conn.Write([]byte(frame)); err != nil {
+		return 0, err
+	}
+	return len(p) + 1, nil
+}
+
+func (f RsyslogFormat) priority() syslog.Priority {
+	facility, ok := facilities[f.Facility]
+	if !ok {
+		facility = syslog.LOG_USER
+	}
+	severity, ok := severities[f.Severity]
+	if !ok {
+		severity = syslog.LOG_DEBUG
+	}
+	return facility | severity
+}
+
+func (f RsyslogFormat) formatter() Formatter {
+	pri := f.priority()
+	if f.Format == "rfc5424" {
+		return RFC5424Formatter(pri)
+	}
+	return RFC3164Formatter(pri)
+}
+
+type PublisherRsyslog struct {
+	ch        chan string
+	raddr     string
+	network   string
+	tlsConfig *tls.Config
+	tag       string
+	hostname  string
+	formatter Formatter
+
+	mu   sync.Mutex
+	conn net.Conn
+	gate *overflowGate
+
+	closer *closer
+
+	messagesWritten uint64
+	reconnects      uint64
+	writeDropped    uint64
+
+	lastErrMu sync.Mutex
+	lastErr   string
+}
+
+func (this *PublisherRsyslog) Push(s string) bool {
+	return this.closer.withOpen(func() bool {
+		return this.gate.push(this.ch, s)
+	})
+}
+
+func (this *PublisherRsyslog) Stats() PublisherStats {
+	this.lastErrMu.Lock()
+	lastErr := this.lastErr
+	this.lastErrMu.Unlock()
+	return PublisherStats{
+		MessagesWritten: atomic.LoadUint64(&this.messagesWritten),
+		Reconnects:      atomic.LoadUint64(&this.reconnects),
+		Dropped:         atomic.LoadUint64(&this.writeDropped) + this.gate.droppedCount(),
+		LastError:       lastErr,
+	}
+}
+
+func (this *PublisherRsyslog) recordError(err error) {
+	this.lastErrMu.Lock()
+	this.lastErr = err.Error()
+	this.lastErrMu.Unlock()
+}
+
+func (this *PublisherRsyslog) Close(ctx context.Context) error {
+	if !this.closer.beginClose() {
+		return nil
+	}
+	close(this.ch)
+	close(this.gate.stop)
+	err := this.closer.waitDone(ctx)
+
+	this.mu.Lock()
+	if this.conn != nil {
+		this.conn.Close()
+	}
+	this.mu.Unlock()
+
+	return err
+}
+
+func (this *PublisherRsyslog) start() {
+	go func() {
+		for s := range this.ch {
+			this.writeWithReconnect(s)
+		}
+		this.closer.markDone()
+	}()
+}
+
+// writeWithReconnect writes s to the current connection. If the write fails
+// it redials with exponential backoff and retries once before giving up and
+// counting the message as dropped.
+func (this *PublisherRsyslog) writeWithReconnect(s string) {
+	line := this.formatter(this.hostname, this.tag, s) + "\n"
+
+	this.mu.Lock()
+	conn := this.conn
+	this.mu.Unlock()
+
+	if conn != nil {
+		if _, err := conn.Write([]byte(line)); err == nil {
+			atomic.AddUint64(&this.messagesWritten, 1)
+			return
+		} else {
+			this.recordError(err)
+		}
+	}
+
+	conn = this.reconnect()
+	if conn == nil {
+		atomic.AddUint64(&this.writeDropped, 1)
+		return
+	}
+
+	if _, err := conn.Write([]byte(line)); err != nil {
+		this.recordError(err)
+		atomic.AddUint64(&this.writeDropped, 1)
+		return
+	}
+	atomic.AddUint64(&this.messagesWritten, 1)
+}
+
+// reconnect closes the stale connection, if any, and redials with
+// exponential backoff capped at rsyslogBackoffMax, jittered by up to 20%.
+// It retries forever, since there is no other place the transaction log
+// data could go, but aborts early once Close begins - otherwise a down
+// endpoint would park the consumer goroutine here past Close(ctx) forever,
+// so markDone never runs and the goroutine leaks. Returns nil if it aborted
+// for that reason instead of a connection.
+func (this *PublisherRsyslog) reconnect() net.Conn {
+	this.mu.Lock()
+	if this.conn != nil {
+		this.conn.Close()
+		this.conn = nil
+	}
+	this.mu.Unlock()
+
+	backoff := rsyslogBackoffInitial
+	for {
+		select {
+		case <-this.closer.closingCh():
+			return nil
+		default:
+		}
+
+		conn, err := dialRsyslog(this.network, this.raddr, this.tlsConfig)
+		if err == nil {
+			atomic.AddUint64(&this.reconnects, 1)
+			this.mu.Lock()
+			this.conn = conn
+			this.mu.Unlock()
+			return conn
+		}
+		this.recordError(err)
+
+		jitter := time.Duration(rand.Int63n(int64(backoff) / 5))
+		select {
+		case <-time.After(backoff + jitter):
+		case <-this.closer.closingCh():
+			return nil
+		}
+		backoff *= 2
+		if backoff > rsyslogBackoffMax {
+			backoff = rsyslogBackoffMax
+		}
+	}
+}
+
+// dialRsyslog opens the transport for network ("tcp", "udp", "tls" or
+// "unixgram"), wrapping TLS connections in the RFC5425 octet-counting framer.
+func dialRsyslog(network, raddr string, tlsConfig *tls.Config) (net.Conn, error) {
+	switch network {
+	case "tls":
+		conn, err := tls.Dial("tcp", raddr, tlsConfig)
+		if err != nil {
+			return nil, err
+		}
+		return octetFramer{conn}, nil
+	case "unixgram":
+		return net.Dial("unixgram", raddr)
+	default:
+		return net.Dial(network, raddr)
+	}
+}
+
+func NewRsyslog(logChSize int, host string, port int, opts RsyslogOptions) (Publisher, error) {
+	network := opts.Network
+	if network == "" {
+		network = "tcp"
+	}
+
+	raddr := host
+	if network != "unixgram" {
+		raddr = fmt.Sprintf("%s:%d", host, port)
+	}
+
+	conn, err := dialRsyslog(network, raddr, opts.TLSConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "localhost"
+	}
+
+	publisher := &PublisherRsyslog{
+		ch:        make(chan string, logChSize),
+		raddr:     raddr,
+		network:   network,
+		tlsConfig: opts.TLSConfig,
+		tag:       opts.Tag,
+		hostname:  hostname,
+		formatter: opts.formatter(),
+		conn:      conn,
+		// Default to drop-oldest: a reconnect loop that retries forever must
+		// not let a blocked Push stall the DNS hot path.
+		gate:   newOverflowGateWithDefault(OverflowDropOldest),
+		closer: newCloser(),
+	}
+
+	publisher.start()
+	return publisher, nil
+}
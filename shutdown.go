@@ -0,0 +1,68 @@
+package transactionlogger
+
+import (
+	"context"
+	"sync"
+)
+
+// closer coordinates a graceful Close(ctx) across the publishers: it stops
+// Push from racing with channel close, and lets Close wait for the consumer
+// goroutine to actually drain and exit.
+type closer struct {
+	mu      sync.RWMutex
+	closed  bool
+	closing chan struct{}
+	done    chan struct{}
+}
+
+func newCloser() *closer {
+	return &closer{closing: make(chan struct{}), done: make(chan struct{})}
+}
+
+// withOpen runs fn and returns its result, or false without running fn if
+// the publisher has already been closed. Holding the read lock for the
+// duration of fn prevents Close from closing the channel fn sends on.
+func (c *closer) withOpen(fn func() bool) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.closed {
+		return false
+	}
+	return fn()
+}
+
+// beginClose marks the publisher closed and reports whether this call is
+// the one that should do the closing work; a later call returns false. It
+// also closes closing(), so a long-running background loop - e.g. rsyslog's
+// reconnect backoff, which otherwise retries forever - can select on it to
+// abort as soon as Close begins instead of leaking past it.
+func (c *closer) beginClose() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return false
+	}
+	c.closed = true
+	close(c.closing)
+	return true
+}
+
+// closing returns a channel that is closed once beginClose has run.
+func (c *closer) closingCh() <-chan struct{} {
+	return c.closing
+}
+
+func (c *closer) markDone() {
+	close(c.done)
+}
+
+// waitDone blocks until markDone is called or ctx is done, whichever comes
+// first.
+func (c *closer) waitDone(ctx context.Context) error {
+	select {
+	case <-c.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
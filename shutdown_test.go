@@ -0,0 +1,50 @@
+package transactionlogger
+
+import (
+	"bufio"
+	"context"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestPublisherStdoutCloseFlushesQueuedMessages(t *testing.T) {
+	tmp, err := os.CreateTemp("", "transactionlogger-shutdown-*.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tmp.Name())
+
+	const count = 1000
+	publisher := NewStdout(count, tmp)
+	for i := 0; i < count; i++ {
+		if !publisher.Push("transaction") {
+			t.Fatalf("Push unexpectedly dropped message %d", i)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := publisher.Close(ctx); err != nil {
+		t.Fatalf("Close returned an error with ample deadline: %v", err)
+	}
+
+	if publisher.Push("after close") {
+		t.Fatal("Push after Close should be rejected")
+	}
+
+	f, err := os.Open(tmp.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	lines := 0
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lines++
+	}
+	if lines != count {
+		t.Fatalf("expected %d flushed lines, got %d", count, lines)
+	}
+}
@@ -1,66 +1,97 @@
 package transactionlogger
 
 import (
+	"context"
 	"flag"
 	"fmt"
-	"log/syslog"
+	"net/url"
 	"os"
-	"regexp"
 	"strconv"
+	"sync/atomic"
 )
 
 type Publisher interface {
-	Push(s string)
+	// Push queues s for delivery. It never blocks for longer than the
+	// configured overflow policy allows and returns false if s was dropped.
+	Push(s string) bool
+	// Stats returns a snapshot of the publisher's delivery counters.
+	Stats() PublisherStats
+	// Close stops accepting new Pushes, drains whatever is already queued
+	// and flushes the underlying writer, and returns once that is done or
+	// ctx is done, whichever comes first.
+	Close(ctx context.Context) error
 }
 
 type LoggerParameters struct {
 	Protocol string
 	Port     int
 	Host     string
+
+	// Query parameters accepted by the rsyslog:// scheme, e.g.
+	// rsyslog://host:514?facility=local3&severity=info&tag=pdns&format=rfc5424
+	Tag      string
+	Facility string
+	Severity string
+	Format   string
+
+	// Query holds the remaining URL query parameters verbatim, e.g. the
+	// file:// rotation knobs max_size/max_age/max_backups/compress/fsync.
+	Query map[string]string
 }
 
-func ParseLoggerUrl(url string) (logger LoggerParameters, e error) {
-	switch url {
+func ParseLoggerUrl(raw string) (logger LoggerParameters, e error) {
+	switch raw {
 	case "debug", "stdout", "stderr", "dummy", "sink":
-		return LoggerParameters{Protocol: url,
+		return LoggerParameters{Protocol: raw,
 			Port: 0,
 			Host: "localhost",
 		}, nil
 	}
 
-	// Parse  'rsync://127.0.0.1:3306'
-	// Try the regex https://regex101.com/ Tip: there is a code generator
-	var reLoggerURL = regexp.MustCompile(`(?m)(\S+)://(\S+):([0-9]+)`)
-
-	if match := reLoggerURL.FindStringSubmatch(url); match != nil {
-		port, _ := strconv.Atoi(match[3])
-		logger = LoggerParameters{
-			Port:     port,
-			Host:     match[2],
-			Protocol: match[1],
-		}
-		return logger, nil
+	u, err := url.Parse(raw)
+	if err != nil || u.Scheme == "" {
+		return logger, fmt.Errorf("Failed to parse %s", raw)
 	}
 
-	// Parse 'file://var/log/logfile'
-	var reLoggerProtocol = regexp.MustCompile(`(?m)(\S+)://(\S+)`)
-	if match := reLoggerProtocol.FindStringSubmatch(url); match != nil {
-		protocol := match[1]
-		port := 0
-		switch protocol {
-		case "rsyslog":
+	host := u.Hostname()
+	port := 0
+	if portStr := u.Port(); portStr != "" {
+		port, _ = strconv.Atoi(portStr)
+	} else {
+		switch u.Scheme {
+		case "rsyslog", "rsyslog+tcp", "rsyslog+udp":
 			port = 514
-		default:
-			port = 0
-		}
-		logger = LoggerParameters{
-			Port:     port,
-			Host:     match[2],
-			Protocol: protocol,
+		case "rsyslog+tls":
+			port = 6514
 		}
-		return logger, nil
 	}
-	return logger, fmt.Errorf("Failed to parse %s", url)
+	switch u.Scheme {
+	case "file", "unixgram":
+		// The location is a filesystem path, not a host:port authority. Two
+		// forms are accepted: the absolute 'file:///var/log/logfile' (Host
+		// is empty, Path is "/var/log/logfile") and the historical relative
+		// 'file://var/log/logfile' (url.Parse takes the first path segment
+		// as Host) - concatenating Host+Path reconstructs either.
+		host = u.Host + u.Path
+	}
+
+	query := u.Query()
+	flatQuery := make(map[string]string, len(query))
+	for key := range query {
+		flatQuery[key] = query.Get(key)
+	}
+
+	logger = LoggerParameters{
+		Protocol: u.Scheme,
+		Host:     host,
+		Port:     port,
+		Tag:      query.Get("tag"),
+		Facility: query.Get("facility"),
+		Severity: query.Get("severity"),
+		Format:   query.Get("format"),
+		Query:    flatQuery,
+	}
+	return logger, nil
 }
 
 // Get environment variable TRANSACTION_LOGGER
@@ -86,12 +117,38 @@ func New() (transactionLogger Publisher, msg string) {
 	}
 
 	switch transactionLoggerParams.Protocol {
-	case "rsyslog":
-		transactionLogger, err = NewRsyslog(logChSize, transactionLoggerParams.Host, transactionLoggerParams.Port, "")
+	case "rsyslog", "rsyslog+tcp", "rsyslog+udp", "rsyslog+tls", "unixgram":
+		network := map[string]string{
+			"rsyslog":     "tcp",
+			"rsyslog+tcp": "tcp",
+			"rsyslog+udp": "udp",
+			"rsyslog+tls": "tls",
+			"unixgram":    "unixgram",
+		}[transactionLoggerParams.Protocol]
+
+		opts := RsyslogOptions{
+			Network: network,
+			RsyslogFormat: RsyslogFormat{
+				Tag:      transactionLoggerParams.Tag,
+				Facility: transactionLoggerParams.Facility,
+				Severity: transactionLoggerParams.Severity,
+				Format:   transactionLoggerParams.Format,
+			},
+		}
+		if network == "tls" {
+			opts.TLSConfig, err = TLSConfigFromEnv()
+			if err != nil {
+				msg = fmt.Sprintf("Failed to build TLS config for rsyslog: %v", err)
+				transactionLogger = NewDummy()
+				break
+			}
+		}
+
+		transactionLogger, err = NewRsyslog(logChSize, transactionLoggerParams.Host, transactionLoggerParams.Port, opts)
 		if err != nil {
-			msg = fmt.Sprintf("Failed to dial rsyslog %s:%d %v", transactionLoggerParams.Host, transactionLoggerParams.Port, err)
+			msg = fmt.Sprintf("Failed to dial %s %s:%d %v", transactionLoggerParams.Protocol, transactionLoggerParams.Host, transactionLoggerParams.Port, err)
 		} else {
-			msg = fmt.Sprintf("Transaction log goes to rsyslog %s:%d", transactionLoggerParams.Host, transactionLoggerParams.Port)
+			msg = fmt.Sprintf("Transaction log goes to %s %s:%d", transactionLoggerParams.Protocol, transactionLoggerParams.Host, transactionLoggerParams.Port)
 		}
 	case "dummy", "sink":
 		transactionLogger = NewDummy()
@@ -107,17 +164,18 @@ func New() (transactionLogger Publisher, msg string) {
 		msg = "Transaction log goes to the stderr"
 	case "file":
 		filename := transactionLoggerParams.Host
-		err := os.Chmod(filename, os.ModePerm)
+		fileOpts, err := FileOptionsFromQuery(transactionLoggerParams.Query)
 		if err != nil {
-			msg = fmt.Sprintf("Failed to chmode '%s'", filename)
+			msg = fmt.Sprintf("Failed to parse rotation options for '%s': %v", filename, err)
 			transactionLogger = NewDummy()
+			break
 		}
-		f, err := os.Create(filename)
+
+		transactionLogger, err = NewFile(logChSize, filename, fileOpts)
 		if err != nil {
-			msg = fmt.Sprintf("Failed to open transaction log file '%s' for writing", filename)
+			msg = fmt.Sprintf("Failed to open transaction log file '%s' for writing: %v", filename, err)
 			transactionLogger = NewDummy()
 		} else {
-			transactionLogger = NewStdout(logChSize, f)
 			msg = fmt.Sprintf("Transaction log goes to the file '%s'", filename)
 		}
 	}
@@ -126,7 +184,7 @@ func New() (transactionLogger Publisher, msg string) {
 }
 
 func NewStdout(logChSize int, outputIo *os.File) Publisher {
-	publisher := &PublisherStdout{ch: make(chan string, logChSize), outputIo: outputIo}
+	publisher := &PublisherStdout{ch: make(chan string, logChSize), outputIo: outputIo, gate: newOverflowGate(), closer: newCloser()}
 	publisher.start()
 	return publisher
 }
@@ -143,30 +201,6 @@ func NewDummy() Publisher {
 	return publisher
 }
 
-func NewRsyslog(logChSize int, host string, port int, tag string) (Publisher, error) {
-	raddr := fmt.Sprintf("%s:%d", host, port)
-	isUdp := false
-	flag.BoolVar(&isUdp, "--udp", false, "use UDP when connecting to rsyslog")
-	protocol := "tcp"
-	if isUdp {
-		protocol = "udp"
-	}
-	logwriter, err := syslog.Dial(protocol, raddr, syslog.LOG_DEBUG, tag)
-	if err != nil {
-		return nil, err
-	}
-
-	publisher := &PublisherRsyslog{
-		ch:     make(chan string, logChSize),
-		raddr:  raddr,
-		writer: logwriter,
-		tag:    tag,
-	}
-
-	publisher.start()
-	return publisher, nil
-}
-
 type Shippable interface {
 	Log() (string, error)
 }
@@ -174,50 +208,72 @@ type Shippable interface {
 type PublisherDummy struct {
 }
 
-func (this *PublisherDummy) Push(s string) {
+func (this *PublisherDummy) Push(s string) bool {
+	return true
 }
 
-type PublisherDebug struct {
+func (this *PublisherDummy) Stats() PublisherStats {
+	return PublisherStats{}
 }
 
-func (this *PublisherDebug) Push(s string) {
-	fmt.Printf("Transaction %s", s)
+func (this *PublisherDummy) Close(ctx context.Context) error {
+	return nil
 }
 
-type PublisherRsyslog struct {
-	ch     chan string
-	raddr  string
-	tag    string
-	writer *syslog.Writer
+type PublisherDebug struct {
 }
 
-func (this *PublisherRsyslog) Push(s string) {
-	this.ch <- s
+func (this *PublisherDebug) Push(s string) bool {
+	fmt.Printf("Transaction %s", s)
+	return true
 }
 
-func (this *PublisherRsyslog) start() {
-	go func() {
-		for {
-			s := <-this.ch
-			this.writer.Debug(s + "\n")
-		}
-	}()
+func (this *PublisherDebug) Stats() PublisherStats {
+	return PublisherStats{}
+}
+
+func (this *PublisherDebug) Close(ctx context.Context) error {
+	return nil
 }
 
 type PublisherStdout struct {
 	outputIo *os.File
 	ch       chan string
+	gate     *overflowGate
+	closer   *closer
+
+	messagesWritten uint64
+}
+
+func (this *PublisherStdout) Push(s string) bool {
+	return this.closer.withOpen(func() bool {
+		return this.gate.push(this.ch, s)
+	})
 }
 
-func (this *PublisherStdout) Push(s string) {
-	this.ch <- s
+func (this *PublisherStdout) Stats() PublisherStats {
+	return PublisherStats{
+		MessagesWritten: atomic.LoadUint64(&this.messagesWritten),
+		Dropped:         this.gate.droppedCount(),
+	}
+}
+
+func (this *PublisherStdout) Close(ctx context.Context) error {
+	if !this.closer.beginClose() {
+		return nil
+	}
+	close(this.ch)
+	close(this.gate.stop)
+	return this.closer.waitDone(ctx)
 }
 
 func (this *PublisherStdout) start() {
 	go func() {
-		for {
-			s := <-this.ch
+		for s := range this.ch {
 			this.outputIo.WriteString(s + "\n")
+			atomic.AddUint64(&this.messagesWritten, 1)
 		}
+		this.outputIo.Sync()
+		this.closer.markDone()
 	}()
 }